@@ -0,0 +1,277 @@
+package vaultclient
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/hashicorp/nomad/nomad/structs/config"
+	vaultapi "github.com/hashicorp/vault/api"
+)
+
+const (
+	// defaultKubernetesJWTPath is where Kubernetes mounts the service
+	// account token used to authenticate to Vault's kubernetes auth
+	// backend.
+	defaultKubernetesJWTPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+	// stsGetCallerIdentityBody is the fixed request body Vault's aws
+	// auth backend expects to have been signed.
+	stsGetCallerIdentityBody = "Action=GetCallerIdentity&Version=2011-06-15"
+)
+
+// AuthMethod logs in to Vault on behalf of the Nomad client, returning the
+// *vaultapi.Secret containing the resulting client token (and, critically,
+// its Auth.LeaseDuration so the login itself can be tracked for renewal).
+type AuthMethod interface {
+	Login(client *vaultapi.Client) (*vaultapi.Secret, error)
+}
+
+// NewAuthMethod builds the AuthMethod described by vaultConfig.
+func NewAuthMethod(vaultConfig *config.VaultConfig) (AuthMethod, error) {
+	switch strings.ToLower(vaultConfig.AuthMethod) {
+	case "", "token":
+		if vaultConfig.Token == "" {
+			return nil, fmt.Errorf("no auth method configured")
+		}
+		return &TokenAuth{token: vaultConfig.Token}, nil
+
+	case "approle":
+		cfg := vaultConfig.AppRoleAuthConfig
+		if cfg == nil || cfg.RoleID == "" {
+			return nil, fmt.Errorf("approle auth method requires a role_id")
+		}
+		mount := cfg.Mount
+		if mount == "" {
+			mount = "approle"
+		}
+		return &AppRoleAuth{
+			roleID:   cfg.RoleID,
+			secretID: cfg.SecretID,
+			mount:    mount,
+		}, nil
+
+	case "aws-iam":
+		cfg := vaultConfig.AWSIAMAuthConfig
+		if cfg == nil || cfg.Role == "" {
+			return nil, fmt.Errorf("aws-iam auth method requires a role")
+		}
+		mount := cfg.Mount
+		if mount == "" {
+			mount = "aws"
+		}
+		return &AWSIAMAuth{
+			role:                cfg.Role,
+			mount:               mount,
+			serverIDHeaderValue: cfg.ServerIDHeaderValue,
+			region:              cfg.Region,
+		}, nil
+
+	case "kubernetes":
+		cfg := vaultConfig.KubernetesAuthConfig
+		if cfg == nil || cfg.Role == "" {
+			return nil, fmt.Errorf("kubernetes auth method requires a role")
+		}
+		mount := cfg.Mount
+		if mount == "" {
+			mount = "kubernetes"
+		}
+		jwtPath := cfg.JWTPath
+		if jwtPath == "" {
+			jwtPath = defaultKubernetesJWTPath
+		}
+		return &KubernetesAuth{
+			role:    cfg.Role,
+			mount:   mount,
+			jwtPath: jwtPath,
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported vault auth method %q", vaultConfig.AuthMethod)
+	}
+}
+
+// TokenAuth "logs in" using a pre-issued periodic token. It is the
+// backwards-compatible default when only vault.token is set.
+type TokenAuth struct {
+	token string
+}
+
+func (a *TokenAuth) Login(client *vaultapi.Client) (*vaultapi.Secret, error) {
+	client.SetToken(a.token)
+
+	secret, err := client.Auth().Token().LookupSelf()
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup periodic_token: %v", err)
+	}
+
+	renewable, err := secret.TokenIsRenewable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine if periodic_token is renewable: %v", err)
+	}
+
+	var leaseDuration int
+	if ttl, err := secret.TokenTTL(); err == nil {
+		leaseDuration = int(ttl.Seconds())
+	}
+
+	// LookupSelf reports the token's metadata via Secret.Data, not
+	// Secret.Auth (that's only populated by auth/*/login and token
+	// create/renew calls). Fill in an Auth block carrying the
+	// already-configured token so login()/track() have something to key
+	// off of, same as every other auth method's response.
+	secret.Auth = &vaultapi.SecretAuth{
+		ClientToken:   a.token,
+		Renewable:     renewable,
+		LeaseDuration: leaseDuration,
+	}
+
+	return secret, nil
+}
+
+// AppRoleAuth logs in via Vault's auth/approle backend.
+type AppRoleAuth struct {
+	roleID   string
+	secretID string
+	mount    string
+}
+
+func (a *AppRoleAuth) Login(client *vaultapi.Client) (*vaultapi.Secret, error) {
+	body := map[string]interface{}{
+		"role_id":   a.roleID,
+		"secret_id": a.secretID,
+	}
+
+	secret, err := client.Logical().Write(fmt.Sprintf("auth/%s/login", a.mount), body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to login with approle: %v", err)
+	}
+	if secret == nil || secret.Auth == nil || secret.Auth.ClientToken == "" {
+		return nil, fmt.Errorf("failed to login with approle: no auth info returned")
+	}
+
+	return secret, nil
+}
+
+// AWSIAMAuth logs in via Vault's auth/aws backend using the IAM
+// authentication method: a pre-signed sts:GetCallerIdentity request is
+// forwarded to Vault, which validates it against AWS on our behalf.
+type AWSIAMAuth struct {
+	role                string
+	mount               string
+	serverIDHeaderValue string
+	region              string
+}
+
+func (a *AWSIAMAuth) Login(client *vaultapi.Client) (*vaultapi.Secret, error) {
+	body, err := a.loginRequestBody()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build aws-iam login request: %v", err)
+	}
+
+	secret, err := client.Logical().Write(fmt.Sprintf("auth/%s/login", a.mount), body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to login with aws-iam: %v", err)
+	}
+	if secret == nil || secret.Auth == nil || secret.Auth.ClientToken == "" {
+		return nil, fmt.Errorf("failed to login with aws-iam: no auth info returned")
+	}
+
+	return secret, nil
+}
+
+// loginRequestBody signs an sts:GetCallerIdentity request with the
+// instance/task's AWS credentials and base64-encodes its method, URL,
+// headers and body into the shape Vault's aws auth backend expects for
+// iam_http_request_method/iam_request_url/iam_request_headers/
+// iam_request_body.
+func (a *AWSIAMAuth) loginRequestBody() (map[string]interface{}, error) {
+	req, err := a.signGetCallerIdentity()
+	if err != nil {
+		return nil, err
+	}
+
+	headers, err := json.Marshal(req.Header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode signed request headers: %v", err)
+	}
+
+	return map[string]interface{}{
+		"role":                    a.role,
+		"iam_http_request_method": req.Method,
+		"iam_request_url":         base64.StdEncoding.EncodeToString([]byte(req.URL.String())),
+		"iam_request_headers":     base64.StdEncoding.EncodeToString(headers),
+		"iam_request_body":        base64.StdEncoding.EncodeToString([]byte(stsGetCallerIdentityBody)),
+	}, nil
+}
+
+// signGetCallerIdentity builds and signs the sts:GetCallerIdentity request
+// used to prove our AWS identity to Vault, stamping it with the
+// X-Vault-AWS-IAM-Server-ID header Vault's aws auth backend expects to
+// guard against replay against another Vault cluster.
+func (a *AWSIAMAuth) signGetCallerIdentity() (*http.Request, error) {
+	sess, err := session.NewSession(aws.NewConfig().WithRegion(a.region))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AWS session: %v", err)
+	}
+	creds, err := sess.Config.Credentials.Get()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS credentials: %v", err)
+	}
+
+	endpoint := fmt.Sprintf("https://sts.%s.amazonaws.com/", sess.Config.Region)
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(stsGetCallerIdentityBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	if a.serverIDHeaderValue != "" {
+		req.Header.Set("X-Vault-AWS-IAM-Server-ID", a.serverIDHeaderValue)
+	}
+
+	signer := v4.NewSigner(credentials.NewStaticCredentials(creds.AccessKeyID, creds.SecretAccessKey, creds.SessionToken))
+	_, err = signer.Sign(req, strings.NewReader(stsGetCallerIdentityBody), "sts", *sess.Config.Region, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign request: %v", err)
+	}
+
+	return req, nil
+}
+
+// KubernetesAuth logs in via Vault's auth/kubernetes backend, using the
+// service account JWT Kubernetes mounts into the pod.
+type KubernetesAuth struct {
+	role    string
+	mount   string
+	jwtPath string
+}
+
+func (a *KubernetesAuth) Login(client *vaultapi.Client) (*vaultapi.Secret, error) {
+	jwt, err := ioutil.ReadFile(a.jwtPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read kubernetes service account token from %q: %v", a.jwtPath, err)
+	}
+
+	body := map[string]interface{}{
+		"role": a.role,
+		"jwt":  strings.TrimSpace(string(jwt)),
+	}
+
+	secret, err := client.Logical().Write(fmt.Sprintf("auth/%s/login", a.mount), body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to login with kubernetes auth: %v", err)
+	}
+	if secret == nil || secret.Auth == nil || secret.Auth.ClientToken == "" {
+		return nil, fmt.Errorf("failed to login with kubernetes auth: no auth info returned")
+	}
+
+	return secret, nil
+}
@@ -0,0 +1,126 @@
+package vaultclient
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hashicorp/nomad/nomad/structs/config"
+	vaultapi "github.com/hashicorp/vault/api"
+)
+
+func TestNewAuthMethod_Dispatch(t *testing.T) {
+	cases := []struct {
+		name    string
+		cfg     *config.VaultConfig
+		wantErr bool
+		check   func(t *testing.T, m AuthMethod)
+	}{
+		{
+			name:    "defaults to token",
+			cfg:     &config.VaultConfig{Token: "root"},
+			wantErr: false,
+			check: func(t *testing.T, m AuthMethod) {
+				if _, ok := m.(*TokenAuth); !ok {
+					t.Fatalf("got %T, want *TokenAuth", m)
+				}
+			},
+		},
+		{
+			name:    "token method without a token is rejected",
+			cfg:     &config.VaultConfig{AuthMethod: "token"},
+			wantErr: true,
+		},
+		{
+			name:    "approle requires a role_id",
+			cfg:     &config.VaultConfig{AuthMethod: "approle", AppRoleAuthConfig: &config.AppRoleAuthConfig{}},
+			wantErr: true,
+		},
+		{
+			name: "approle defaults its mount",
+			cfg: &config.VaultConfig{
+				AuthMethod:        "approle",
+				AppRoleAuthConfig: &config.AppRoleAuthConfig{RoleID: "role"},
+			},
+			check: func(t *testing.T, m AuthMethod) {
+				a, ok := m.(*AppRoleAuth)
+				if !ok {
+					t.Fatalf("got %T, want *AppRoleAuth", m)
+				}
+				if a.mount != "approle" {
+					t.Fatalf("mount = %q, want %q", a.mount, "approle")
+				}
+			},
+		},
+		{
+			name:    "unsupported method is rejected",
+			cfg:     &config.VaultConfig{AuthMethod: "bogus"},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := NewAuthMethod(tc.cfg)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tc.check != nil {
+				tc.check(t, m)
+			}
+		})
+	}
+}
+
+// TestTokenAuth_Login_PopulatesAuth is a regression test: LookupSelf
+// returns the token's metadata in Secret.Data, not Secret.Auth, so
+// TokenAuth.Login must fill in Secret.Auth itself from the configured
+// token rather than leaving it nil (which previously made every
+// "token" auth method deployment fail to start).
+func TestTokenAuth_Login_PopulatesAuth(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/auth/token/lookup-self" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{
+				"id":        "s.configured-token",
+				"renewable": true,
+				"ttl":       3600,
+			},
+		})
+	}))
+	defer srv.Close()
+
+	client, err := vaultapi.NewClient(vaultapi.DefaultConfig())
+	if err != nil {
+		t.Fatalf("failed to create vault client: %v", err)
+	}
+	client.SetAddress(srv.URL)
+
+	auth := &TokenAuth{token: "s.configured-token"}
+	secret, err := auth.Login(client)
+	if err != nil {
+		t.Fatalf("Login returned error: %v", err)
+	}
+	if secret == nil || secret.Auth == nil {
+		t.Fatalf("Login returned no Auth block")
+	}
+	if secret.Auth.ClientToken != "s.configured-token" {
+		t.Fatalf("ClientToken = %q, want %q", secret.Auth.ClientToken, "s.configured-token")
+	}
+	if !secret.Auth.Renewable {
+		t.Fatalf("Renewable = false, want true")
+	}
+	if secret.Auth.LeaseDuration != 3600 {
+		t.Fatalf("LeaseDuration = %d, want 3600", secret.Auth.LeaseDuration)
+	}
+}
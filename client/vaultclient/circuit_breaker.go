@@ -0,0 +1,52 @@
+package vaultclient
+
+import (
+	"sync"
+	"time"
+)
+
+// circuitBreaker pauses new renewals across the whole vaultClient after a
+// run of consecutive renewal failures, so a struggling Vault isn't hammered
+// by every tracked token/lease retrying at once.
+type circuitBreaker struct {
+	lock sync.Mutex
+
+	threshold int
+	cooldown  time.Duration
+
+	consecutiveFailures int
+	openUntil           time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// isOpen reports whether the breaker is currently tripped.
+func (b *circuitBreaker) isOpen() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return time.Now().Before(b.openUntil)
+}
+
+// recordFailure counts a renewal failure, tripping the breaker for
+// cooldown once threshold consecutive failures have been seen.
+func (b *circuitBreaker) recordFailure() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.consecutiveFailures++
+	if b.consecutiveFailures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
+
+// recordSuccess resets the failure count.
+func (b *circuitBreaker) recordSuccess() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.consecutiveFailures = 0
+}
@@ -0,0 +1,50 @@
+package vaultclient
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker_OpensAtThreshold(t *testing.T) {
+	b := newCircuitBreaker(3, 50*time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		b.recordFailure()
+		if b.isOpen() {
+			t.Fatalf("breaker opened after %d failure(s), want 3", i+1)
+		}
+	}
+
+	b.recordFailure()
+	if !b.isOpen() {
+		t.Fatalf("breaker did not open after reaching threshold")
+	}
+}
+
+func TestCircuitBreaker_ClosesAfterCooldown(t *testing.T) {
+	b := newCircuitBreaker(1, 10*time.Millisecond)
+
+	b.recordFailure()
+	if !b.isOpen() {
+		t.Fatalf("breaker did not open")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if b.isOpen() {
+		t.Fatalf("breaker still open after cooldown elapsed")
+	}
+}
+
+func TestCircuitBreaker_SuccessResetsFailureCount(t *testing.T) {
+	b := newCircuitBreaker(3, 50*time.Millisecond)
+
+	b.recordFailure()
+	b.recordFailure()
+	b.recordSuccess()
+	b.recordFailure()
+	b.recordFailure()
+
+	if b.isOpen() {
+		t.Fatalf("breaker opened even though recordSuccess reset the streak")
+	}
+}
@@ -0,0 +1,48 @@
+package vaultclient
+
+import (
+	"testing"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// These are regression tests: DeriveToken's nil guards used to dereference
+// task.Name/alloc.Job.Name before checking the pointer they hang off of was
+// non-nil, panicking on exactly the input they meant to reject.
+
+func TestDeriveToken_NilAllocation(t *testing.T) {
+	c := &vaultClient{}
+
+	if _, err := c.DeriveToken(nil, nil); err == nil {
+		t.Fatalf("expected error for nil allocation, got nil")
+	}
+}
+
+func TestDeriveToken_NilTaskDoesNotPanic(t *testing.T) {
+	c := &vaultClient{}
+	alloc := &structs.Allocation{ID: "alloc-1", Job: &structs.Job{Name: "job-1"}}
+
+	if _, err := c.DeriveToken(alloc, nil); err == nil {
+		t.Fatalf("expected error for nil task, got nil")
+	}
+}
+
+func TestDeriveToken_NilJobDoesNotPanic(t *testing.T) {
+	c := &vaultClient{}
+	alloc := &structs.Allocation{ID: "alloc-1"}
+	task := &structs.Task{Name: "task-1", Vault: &structs.Vault{Policies: []string{"default"}}}
+
+	if _, err := c.DeriveToken(alloc, task); err == nil {
+		t.Fatalf("expected error for alloc with nil Job, got nil")
+	}
+}
+
+func TestDeriveToken_MissingVaultStanza(t *testing.T) {
+	c := &vaultClient{}
+	alloc := &structs.Allocation{ID: "alloc-1", Job: &structs.Job{Name: "job-1"}}
+	task := &structs.Task{Name: "task-1"}
+
+	if _, err := c.DeriveToken(alloc, task); err == nil {
+		t.Fatalf("expected error for task without a vault stanza, got nil")
+	}
+}
@@ -0,0 +1,106 @@
+package vaultclient
+
+import "time"
+
+// RenewalEventKind categorizes a RenewalEvent.
+type RenewalEventKind int
+
+const (
+	// RenewalEventRenewed indicates a lease or token was successfully
+	// renewed and is good until NextRenewal.
+	RenewalEventRenewed RenewalEventKind = iota
+
+	// RenewalEventWarning carries a non-fatal warning surfaced by Vault
+	// on an otherwise successful renewal (e.g. "TTL capped").
+	RenewalEventWarning
+
+	// RenewalEventExpired indicates Vault will no longer renew this
+	// lease or token (its max TTL was reached) and it is about to
+	// expire.
+	RenewalEventExpired
+
+	// RenewalEventFailed indicates renewal failed terminally; the
+	// lease or token is no longer tracked.
+	RenewalEventFailed
+)
+
+// RenewalEvent is pushed to every subscriber of a tracked id each time its
+// renewal state changes, so callers can react to a renewal (e.g. re-render
+// a template) or an expiry (e.g. restart a task) without polling the
+// one-shot error channel returned by RenewToken/RenewLease.
+type RenewalEvent struct {
+	Kind RenewalEventKind
+
+	LeaseID       string
+	LeaseDuration int
+	NextRenewal   time.Time
+	Warnings      []string
+	Err           error
+}
+
+// subscriberBuffer is the size of each subscriber's channel. Subscribers
+// that fall behind have their oldest pending event dropped rather than
+// blocking the renewal goroutine.
+const subscriberBuffer = 100
+
+// Subscribe returns a channel of RenewalEvents for the given tracked id,
+// and an unsubscribe function that must be called once the caller is done
+// reading from it. id need not be tracked yet; its events simply start
+// flowing once it is.
+func (c *vaultClient) Subscribe(id string) (<-chan RenewalEvent, func()) {
+	ch := make(chan RenewalEvent, subscriberBuffer)
+
+	c.subLock.Lock()
+	if c.subscribers == nil {
+		c.subscribers = make(map[string][]chan RenewalEvent)
+	}
+	c.subscribers[id] = append(c.subscribers[id], ch)
+	c.subLock.Unlock()
+
+	unsubscribe := func() {
+		c.subLock.Lock()
+		defer c.subLock.Unlock()
+		subs := c.subscribers[id]
+		for i, sub := range subs {
+			if sub == ch {
+				c.subscribers[id] = append(subs[:i], subs[i+1:]...)
+				break
+			}
+		}
+		if len(c.subscribers[id]) == 0 {
+			delete(c.subscribers, id)
+		}
+		// Deliberately not closed: publish copies the subscriber list
+		// under subLock's read side and sends after releasing it, so a
+		// concurrent publish could still be holding a
+		// reference to ch after it's removed here, and closing would
+		// race it into a "send on closed channel" panic. The channel
+		// is simply dropped and left for the GC.
+	}
+
+	return ch, unsubscribe
+}
+
+// publish fans ev out to every subscriber of id, dropping the oldest
+// buffered event for a subscriber that isn't keeping up rather than
+// blocking.
+func (c *vaultClient) publish(id string, ev RenewalEvent) {
+	c.subLock.RLock()
+	subs := c.subscribers[id]
+	c.subLock.RUnlock()
+
+	for _, ch := range subs {
+		select {
+		case ch <- ev:
+		default:
+			select {
+			case <-ch:
+			default:
+			}
+			select {
+			case ch <- ev:
+			default:
+			}
+		}
+	}
+}
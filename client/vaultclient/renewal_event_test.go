@@ -0,0 +1,71 @@
+package vaultclient
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSubscribe_ReceivesPublishedEvents(t *testing.T) {
+	c := &vaultClient{}
+
+	ch, unsubscribe := c.Subscribe("token-1")
+	defer unsubscribe()
+
+	c.publish("token-1", RenewalEvent{Kind: RenewalEventRenewed, LeaseID: "token-1"})
+
+	select {
+	case ev := <-ch:
+		if ev.LeaseID != "token-1" {
+			t.Fatalf("LeaseID = %q, want %q", ev.LeaseID, "token-1")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for published event")
+	}
+}
+
+func TestPublish_ToUnknownIDIsANoop(t *testing.T) {
+	c := &vaultClient{}
+	// No subscribers for "nobody-listening"; publish must not panic or
+	// block.
+	c.publish("nobody-listening", RenewalEvent{Kind: RenewalEventRenewed})
+}
+
+func TestPublish_DropsOldestWhenSubscriberIsFull(t *testing.T) {
+	c := &vaultClient{}
+
+	ch, unsubscribe := c.Subscribe("token-1")
+	defer unsubscribe()
+
+	for i := 0; i < subscriberBuffer+10; i++ {
+		c.publish("token-1", RenewalEvent{Kind: RenewalEventRenewed, LeaseDuration: i})
+	}
+
+	if len(ch) != subscriberBuffer {
+		t.Fatalf("channel length = %d, want %d", len(ch), subscriberBuffer)
+	}
+}
+
+// TestUnsubscribe_ConcurrentPublishDoesNotPanic is a regression test: publish
+// used to send on a channel after unsubscribe had already closed it, which
+// panics with "send on closed channel". unsubscribe no longer closes the
+// channel, so a publish racing an unsubscribe must complete cleanly.
+func TestUnsubscribe_ConcurrentPublishDoesNotPanic(t *testing.T) {
+	c := &vaultClient{}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		_, unsubscribe := c.Subscribe("token-1")
+
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			c.publish("token-1", RenewalEvent{Kind: RenewalEventRenewed})
+		}()
+		go func() {
+			defer wg.Done()
+			unsubscribe()
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,106 @@
+package vaultclient
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+)
+
+func TestIsPermanentVaultError(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"non-vault error", errors.New("boom"), false},
+		{"403 forbidden", &vaultapi.ResponseError{StatusCode: 403}, true},
+		{"400 bad request", &vaultapi.ResponseError{StatusCode: 400}, true},
+		{"500 internal error", &vaultapi.ResponseError{StatusCode: 500}, false},
+		{"503 unavailable", &vaultapi.ResponseError{StatusCode: 503}, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isPermanentVaultError(tc.err); got != tc.want {
+				t.Fatalf("isPermanentVaultError(%v) = %v, want %v", tc.err, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestBackoffFor_GrowsExponentially(t *testing.T) {
+	c := &vaultClient{retryBackoff: time.Second}
+
+	prevMin := time.Duration(0)
+	for attempt := 1; attempt <= 5; attempt++ {
+		backoff := c.backoffFor(attempt)
+		minExpected := c.retryBackoff * time.Duration(uint(1)<<uint(attempt-1))
+		maxExpected := minExpected + c.retryBackoff
+
+		if backoff < minExpected || backoff >= maxExpected {
+			t.Fatalf("backoffFor(%d) = %s, want within [%s, %s)", attempt, backoff, minExpected, maxExpected)
+		}
+		if minExpected <= prevMin {
+			t.Fatalf("backoffFor(%d) floor %s did not grow past previous floor %s", attempt, minExpected, prevMin)
+		}
+		prevMin = minExpected
+	}
+}
+
+func TestBackoffFor_ClampsPathologicalAttempts(t *testing.T) {
+	c := &vaultClient{retryBackoff: time.Second}
+
+	// Attempt counts beyond 10 must not overflow the shift; backoffFor(100)
+	// should clamp to the same ceiling as backoffFor(10).
+	a10 := c.backoffFor(10)
+	a100 := c.backoffFor(100)
+
+	maxExpected := c.retryBackoff*time.Duration(uint(1)<<9) + c.retryBackoff
+	if a10 >= maxExpected || a100 >= maxExpected {
+		t.Fatalf("backoffFor did not clamp: backoffFor(10)=%s backoffFor(100)=%s want < %s", a10, a100, maxExpected)
+	}
+}
+
+// TestReRenew_StoppedEntryDoesNotInstallRenewer is a regression test: reRenew
+// used to install its freshly-created renewer into entry.renewer
+// unconditionally. If StopRenewToken/StopRenewLease ran concurrently and
+// closed entry.stopCh first, stopRenewal could have already Stop()'d the
+// stale renewer it read before reRenew's new one was installed, leaking a
+// goroutine that keeps renewing a token that was supposed to be revoked.
+// reRenew must instead decline to install (and immediately Stop) its new
+// renewer once entry.stopCh is closed.
+func TestReRenew_StoppedEntryDoesNotInstallRenewer(t *testing.T) {
+	c, srv := testVaultClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"auth": map[string]interface{}{
+				"client_token":   "t1",
+				"accessor":       "acc1",
+				"lease_duration": 60,
+				"renewable":      true,
+			},
+		})
+	}))
+	defer srv.Close()
+
+	entry := &vaultClientHeapEntry{
+		req:    &vaultClientRenewalRequest{id: "token-1", isToken: true, duration: 60},
+		stopCh: make(chan struct{}),
+	}
+	close(entry.stopCh)
+
+	if err := c.reRenew(entry); err == nil {
+		t.Fatalf("expected reRenew to refuse to renew a stopped entry, got nil error")
+	}
+
+	c.lock.Lock()
+	renewer := entry.renewer
+	c.lock.Unlock()
+	if renewer != nil {
+		t.Fatalf("reRenew installed a renewer on an entry whose stopCh was already closed")
+	}
+}
@@ -0,0 +1,200 @@
+package vaultclient
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// revokeBatchSize caps how many pending revocations are attempted
+	// per tick of the revocation goroutine.
+	revokeBatchSize = 32
+
+	// revokeInterval is how often the revocation queue is drained.
+	revokeInterval = 5 * time.Second
+
+	// revokeBaseBackoff is the base of the exponential backoff applied
+	// to a record that fails to revoke.
+	revokeBaseBackoff = 5 * time.Second
+
+	// revokeMaxBackoff caps how long a failing revocation waits between
+	// attempts; it is retried forever rather than given up on, since
+	// dropping it would leak a live credential for its full TTL.
+	revokeMaxBackoff = 5 * time.Minute
+)
+
+// StateDB is the subset of the client's on-disk state store vaultclient
+// needs to persist pending revocations across a client restart. A nil
+// StateDB disables persistence: revocations still happen, but a crash
+// between StopRenewToken/StopRenewLease and the actual revoke leaks the
+// credential for its remaining TTL.
+type StateDB interface {
+	PutVaultAccessor(rec *VaultAccessorRecord) error
+	DeleteVaultAccessor(rec *VaultAccessorRecord) error
+	GetVaultAccessors() ([]*VaultAccessorRecord, error)
+}
+
+// VaultAccessorRecord is a pending revocation: either a token (identified
+// by its accessor, so the raw token need not be retained) or a lease
+// (identified by its lease ID).
+type VaultAccessorRecord struct {
+	AllocID  string
+	Task     string
+	Accessor string
+	LeaseID  string
+
+	nextAttempt time.Time
+	attempts    int
+}
+
+func (r *VaultAccessorRecord) isToken() bool { return r.Accessor != "" }
+
+func (r *VaultAccessorRecord) id() string {
+	if r.isToken() {
+		return r.Accessor
+	}
+	return r.LeaseID
+}
+
+// RevokeToken revokes a token by its accessor, without needing the token
+// itself.
+func (c *vaultClient) RevokeToken(accessor string) error {
+	client, err := c.getVaultAPIClient()
+	if err != nil {
+		return fmt.Errorf("failed to create vault API client: %v", err)
+	}
+
+	_, err = client.Logical().Write("auth/token/revoke-accessor", map[string]interface{}{
+		"accessor": accessor,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to revoke token accessor %q: %v", accessor, err)
+	}
+
+	return nil
+}
+
+// RevokeLease revokes a lease by ID.
+func (c *vaultClient) RevokeLease(leaseID string) error {
+	client, err := c.getVaultAPIClient()
+	if err != nil {
+		return fmt.Errorf("failed to create vault API client: %v", err)
+	}
+
+	if err := client.Sys().Revoke(leaseID); err != nil {
+		return fmt.Errorf("failed to revoke lease %q: %v", leaseID, err)
+	}
+
+	return nil
+}
+
+// enqueueRevocation adds rec to the in-memory and (if configured)
+// persisted revocation queue, to be drained by runRevocationQueue.
+func (c *vaultClient) enqueueRevocation(rec *VaultAccessorRecord) {
+	c.revokeLock.Lock()
+	c.revokeQueue = append(c.revokeQueue, rec)
+	c.revokeLock.Unlock()
+
+	if c.stateDB != nil {
+		if err := c.stateDB.PutVaultAccessor(rec); err != nil {
+			c.logger.Printf("[ERR] vaultclient: failed to persist pending revocation of %q: %v", rec.id(), err)
+		}
+	}
+}
+
+// restorePendingRevocations loads any revocations that were queued but not
+// completed before the last time this client ran, so a crash between
+// StopRenewToken/StopRenewLease and the actual revoke doesn't leak the
+// credential for its remaining TTL.
+func (c *vaultClient) restorePendingRevocations() {
+	if c.stateDB == nil {
+		return
+	}
+
+	recs, err := c.stateDB.GetVaultAccessors()
+	if err != nil {
+		c.logger.Printf("[ERR] vaultclient: failed to load pending revocations: %v", err)
+		return
+	}
+	if len(recs) == 0 {
+		return
+	}
+
+	c.logger.Printf("[INFO] vaultclient: resuming %d pending revocation(s) from prior run", len(recs))
+
+	c.revokeLock.Lock()
+	c.revokeQueue = append(c.revokeQueue, recs...)
+	c.revokeLock.Unlock()
+}
+
+// runRevocationQueue drains the revocation queue in batches of
+// revokeBatchSize every revokeInterval until Stop() is called, retrying
+// failed revocations with an exponential backoff.
+func (c *vaultClient) runRevocationQueue() {
+	ticker := time.NewTicker(revokeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.drainRevocationQueue()
+		case <-c.stopCh:
+			return
+		}
+	}
+}
+
+func (c *vaultClient) drainRevocationQueue() {
+	now := time.Now()
+
+	c.revokeLock.Lock()
+	var due, notYet []*VaultAccessorRecord
+	for _, rec := range c.revokeQueue {
+		if len(due) < revokeBatchSize && now.After(rec.nextAttempt) {
+			due = append(due, rec)
+		} else {
+			notYet = append(notYet, rec)
+		}
+	}
+	c.revokeQueue = notYet
+	c.revokeLock.Unlock()
+
+	for _, rec := range due {
+		var err error
+		if rec.isToken() {
+			err = c.RevokeToken(rec.Accessor)
+		} else {
+			err = c.RevokeLease(rec.LeaseID)
+		}
+
+		if err == nil {
+			if c.stateDB != nil {
+				if derr := c.stateDB.DeleteVaultAccessor(rec); derr != nil {
+					c.logger.Printf("[ERR] vaultclient: failed to clear persisted revocation of %q: %v", rec.id(), derr)
+				}
+			}
+			continue
+		}
+
+		rec.attempts++
+		backoff := revokeBaseBackoff * time.Duration(1<<uint(min(rec.attempts-1, 6)))
+		if backoff > revokeMaxBackoff {
+			backoff = revokeMaxBackoff
+		}
+		rec.nextAttempt = now.Add(backoff)
+
+		c.logger.Printf("[WARN] vaultclient: failed to revoke %q (attempt %d), retrying in %s: %v",
+			rec.id(), rec.attempts, backoff, err)
+
+		c.revokeLock.Lock()
+		c.revokeQueue = append(c.revokeQueue, rec)
+		c.revokeLock.Unlock()
+	}
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
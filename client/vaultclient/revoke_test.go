@@ -0,0 +1,146 @@
+package vaultclient
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	vaultapi "github.com/hashicorp/vault/api"
+)
+
+// fakeStateDB is an in-memory StateDB good enough to exercise
+// drainRevocationQueue's persistence calls without a real client state
+// store.
+type fakeStateDB struct {
+	mu   sync.Mutex
+	recs map[string]*VaultAccessorRecord
+}
+
+func newFakeStateDB() *fakeStateDB {
+	return &fakeStateDB{recs: make(map[string]*VaultAccessorRecord)}
+}
+
+func (f *fakeStateDB) PutVaultAccessor(rec *VaultAccessorRecord) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.recs[rec.id()] = rec
+	return nil
+}
+
+func (f *fakeStateDB) DeleteVaultAccessor(rec *VaultAccessorRecord) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.recs, rec.id())
+	return nil
+}
+
+func (f *fakeStateDB) GetVaultAccessors() ([]*VaultAccessorRecord, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var out []*VaultAccessorRecord
+	for _, rec := range f.recs {
+		out = append(out, rec)
+	}
+	return out, nil
+}
+
+func testVaultClient(t *testing.T, handler http.Handler) (*vaultClient, *httptest.Server) {
+	t.Helper()
+
+	srv := httptest.NewServer(handler)
+
+	apiClient, err := vaultapi.NewClient(vaultapi.DefaultConfig())
+	if err != nil {
+		t.Fatalf("failed to create vault API client: %v", err)
+	}
+	apiClient.SetAddress(srv.URL)
+
+	return &vaultClient{
+		vaultAPIClient: apiClient,
+		circuitBreaker: newCircuitBreaker(defaultCircuitBreakerThreshold, defaultCooldownPeriod),
+		logger:         log.New(ioutil.Discard, "", 0),
+	}, srv
+}
+
+func TestDrainRevocationQueue_RevokesAndClearsPersistedState(t *testing.T) {
+	c, srv := testVaultClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/auth/token/revoke-accessor" {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	stateDB := newFakeStateDB()
+	c.stateDB = stateDB
+
+	rec := &VaultAccessorRecord{AllocID: "alloc-1", Task: "task-1", Accessor: "accessor-1"}
+	c.enqueueRevocation(rec)
+
+	c.drainRevocationQueue()
+
+	c.revokeLock.Lock()
+	remaining := len(c.revokeQueue)
+	c.revokeLock.Unlock()
+	if remaining != 0 {
+		t.Fatalf("revokeQueue length = %d, want 0", remaining)
+	}
+
+	if recs, _ := stateDB.GetVaultAccessors(); len(recs) != 0 {
+		t.Fatalf("persisted accessors = %d, want 0 after successful revoke", len(recs))
+	}
+}
+
+func TestDrainRevocationQueue_RequeuesWithBackoffOnFailure(t *testing.T) {
+	c, srv := testVaultClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "vault unavailable", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	rec := &VaultAccessorRecord{AllocID: "alloc-1", Task: "task-1", Accessor: "accessor-1"}
+	c.enqueueRevocation(rec)
+
+	now := time.Now()
+	c.drainRevocationQueue()
+
+	c.revokeLock.Lock()
+	defer c.revokeLock.Unlock()
+	if len(c.revokeQueue) != 1 {
+		t.Fatalf("revokeQueue length = %d, want 1 (failed revoke must stay queued)", len(c.revokeQueue))
+	}
+
+	requeued := c.revokeQueue[0]
+	if requeued.attempts != 1 {
+		t.Fatalf("attempts = %d, want 1", requeued.attempts)
+	}
+	if !requeued.nextAttempt.After(now) {
+		t.Fatalf("nextAttempt = %s, want after %s", requeued.nextAttempt, now)
+	}
+	if requeued.nextAttempt.Before(now.Add(revokeBaseBackoff)) {
+		t.Fatalf("nextAttempt = %s, want at least %s after enqueue", requeued.nextAttempt, revokeBaseBackoff)
+	}
+}
+
+func TestDrainRevocationQueue_CapsBatchSize(t *testing.T) {
+	c, srv := testVaultClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	for i := 0; i < revokeBatchSize+5; i++ {
+		c.revokeQueue = append(c.revokeQueue, &VaultAccessorRecord{Accessor: "accessor"})
+	}
+
+	c.drainRevocationQueue()
+
+	c.revokeLock.Lock()
+	defer c.revokeLock.Unlock()
+	if len(c.revokeQueue) != 5 {
+		t.Fatalf("revokeQueue length = %d, want 5 (only %d should be drained per tick)", len(c.revokeQueue), revokeBatchSize)
+	}
+}
@@ -1,96 +1,258 @@
 package vaultclient
 
 import (
-	"container/heap"
 	"fmt"
 	"log"
+	"math/rand"
 	"sync"
 	"time"
 
+	"github.com/hashicorp/nomad/nomad/structs"
 	"github.com/hashicorp/nomad/nomad/structs/config"
 	vaultapi "github.com/hashicorp/vault/api"
 	vaultduration "github.com/hashicorp/vault/helper/duration"
 )
 
+const (
+	// defaultRenewalStartPercent is the percentage of a lease's TTL that
+	// must elapse before we attempt to renew it, absent an override in
+	// the Vault config.
+	defaultRenewalStartPercent = 0.8
+
+	// defaultRenewalWindow bounds the jitter applied around the renewal
+	// start percentage so that many renewers don't all wake up at once.
+	defaultRenewalWindow = 30 * time.Second
+
+	// defaultMaxRetries caps how many times a transiently-failing
+	// renewal is retried before the error is surfaced to the caller.
+	defaultMaxRetries = 5
+
+	// defaultRetryBackoff is the base of the exponential backoff used
+	// between retries.
+	defaultRetryBackoff = 2 * time.Second
+
+	// defaultCircuitBreakerThreshold is the number of consecutive
+	// renewal failures, across all tracked entries, that trips the
+	// circuit breaker.
+	defaultCircuitBreakerThreshold = 5
+
+	// defaultCooldownPeriod is how long the circuit breaker pauses new
+	// renewals once tripped.
+	defaultCooldownPeriod = 30 * time.Second
+
+	// defaultWrapTTL is how long a derived token's wrapping token is
+	// valid for, absent an override in the Vault config.
+	defaultWrapTTL = 60 * time.Second
+)
+
 type VaultClient interface {
 	Start()
 	Stop()
-	DeriveToken() (string, error)
+	DeriveToken(alloc *structs.Allocation, task *structs.Task) (string, error)
 	GetConsulACL(string, string) (*vaultapi.Secret, error)
 	RenewToken(string) <-chan error
+	RenewTokenForTask(token string, alloc *structs.Allocation, task *structs.Task) <-chan error
 	StopRenewToken(string) error
 	RenewLease(string, int) <-chan error
 	StopRenewLease(string) error
+	RevokeToken(accessor string) error
+	RevokeLease(leaseID string) error
+	Subscribe(id string) (<-chan RenewalEvent, func())
 }
 
+// loginRenewalID is the heap key under which we track the renewal of our
+// own login lease, so it rides the same track/evict machinery as every
+// task token and lease.
+const loginRenewalID = "vault-client-login"
+
 type vaultClient struct {
-	running        bool
-	token          string
-	taskTokenTTL   string
+	running bool
+	token   string
+
+	// authMethod logs the client in to Vault. It replaces the old
+	// hard requirement on vaultConfig.Token.
+	authMethod AuthMethod
+
+	taskTokenTTL            string
+	taskTokenWrapTTL        time.Duration
+	taskTokenExplicitMaxTTL string
+	taskTokenNumUses        int
+
+	// renewalStartPercent and renewalWindow control when a tracked
+	// secret's vaultapi.Renewer is given the go-ahead to renew: after
+	// TTL*renewalStartPercent has elapsed, plus or minus a random
+	// jitter bounded by renewalWindow.
+	renewalStartPercent float64
+	renewalWindow       time.Duration
+
+	// maxRetries and retryBackoff govern how a transiently-failing
+	// renewal is retried before giving up; circuitBreaker pauses new
+	// renewals across all entries after a run of failures.
+	maxRetries     int
+	retryBackoff   time.Duration
+	circuitBreaker *circuitBreaker
+
 	vaultAPIClient *vaultapi.Client
-	updateCh       chan struct{}
 	stopCh         chan struct{}
 	heap           *vaultClientHeap
 	lock           sync.RWMutex
 	logger         *log.Logger
+
+	// stateDB persists the revocation queue across client restarts; nil
+	// disables persistence. revokeQueue/revokeLock back StopRenewToken/
+	// StopRenewLease, drained by runRevocationQueue.
+	stateDB     StateDB
+	revokeQueue []*VaultAccessorRecord
+	revokeLock  sync.Mutex
+
+	// subscribers and subLock back Subscribe; kept separate from lock
+	// so publishing an event never has to fight over the heap's lock.
+	subscribers map[string][]chan RenewalEvent
+	subLock     sync.RWMutex
 }
 
+// vaultClientRenewalRequest describes something we have been asked to keep
+// alive: either a token (isToken == true) or a lease.
 type vaultClientRenewalRequest struct {
 	errCh    chan error
 	id       string
 	duration int
 	isToken  bool
+
+	// allocID and task identify, when known, the allocation/task this
+	// renewal was derived for, so audit logs and renewal events can
+	// attribute failures to something actionable.
+	allocID string
+	task    string
 }
 
+// vaultClientHeapEntry is the bookkeeping we keep per tracked id. Despite
+// the name (left over from when this was a priority queue), the heap is
+// now purely an index: actual renewal scheduling happens inside the
+// per-entry vaultapi.Renewer goroutine started by startRenewal.
 type vaultClientHeapEntry struct {
-	req   *vaultClientRenewalRequest
-	next  time.Time
-	index int
+	req     *vaultClientRenewalRequest
+	renewer *vaultapi.Renewer
+	stopCh  chan struct{}
+
+	// retries counts consecutive transient renewal failures since the
+	// last success, and expiry is the original lease expiry used to
+	// make sure retries don't run past it.
+	retries int
+	expiry  time.Time
+
+	// accessor is the token's accessor, kept alongside it so it can be
+	// revoked by RevokeToken even after the raw token has been
+	// discarded from memory.
+	accessor string
 }
 
+// vaultClientHeap is a map-backed index of everything currently being kept
+// alive, keyed by token or lease ID, so that IsTracked/StopRenewToken/
+// StopRenewLease can look up and stop a renewer in O(1).
 type vaultClientHeap struct {
 	heapMap map[string]*vaultClientHeapEntry
-	heap    vaultDataHeapImp
 }
 
-type vaultDataHeapImp []*vaultClientHeapEntry
-
-func NewVaultClient(vaultConfig *config.VaultConfig, logger *log.Logger) (*vaultClient, error) {
+func NewVaultClient(vaultConfig *config.VaultConfig, logger *log.Logger, stateDB StateDB) (*vaultClient, error) {
 	if vaultConfig == nil {
 		return nil, fmt.Errorf("nil, vaultConfig")
 	}
-	if vaultConfig.Token == "" {
-		return nil, fmt.Errorf("periodic_token not set")
+
+	authMethod, err := NewAuthMethod(vaultConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapTTL := defaultWrapTTL
+	if vaultConfig.TaskTokenWrapTTL != "" {
+		d, err := vaultduration.ParseDurationSecond(vaultConfig.TaskTokenWrapTTL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse task_token_wrap_ttl: %v", err)
+		}
+		wrapTTL = d
 	}
 
 	return &vaultClient{
-		token:        vaultConfig.Token,
-		taskTokenTTL: vaultConfig.TaskTokenTTL,
-		stopCh:       make(chan struct{}),
-		updateCh:     make(chan struct{}, 1),
-		heap:         NewVaultDataHeap(),
-		logger:       logger,
+		authMethod:              authMethod,
+		stateDB:                 stateDB,
+		taskTokenTTL:            vaultConfig.TaskTokenTTL,
+		taskTokenWrapTTL:        wrapTTL,
+		taskTokenExplicitMaxTTL: vaultConfig.TaskTokenExplicitMaxTTL,
+		taskTokenNumUses:        vaultConfig.TaskTokenNumUses,
+		renewalStartPercent:     defaultRenewalStartPercent,
+		renewalWindow:           defaultRenewalWindow,
+		maxRetries:              defaultMaxRetries,
+		retryBackoff:            defaultRetryBackoff,
+		circuitBreaker:          newCircuitBreaker(defaultCircuitBreakerThreshold, defaultCooldownPeriod),
+		stopCh:                  make(chan struct{}),
+		heap:                    NewVaultDataHeap(),
+		logger:                  logger,
 	}, nil
 }
 
 func NewVaultDataHeap() *vaultClientHeap {
 	return &vaultClientHeap{
 		heapMap: make(map[string]*vaultClientHeapEntry),
-		heap:    make(vaultDataHeapImp, 0),
 	}
 }
 
 func (c *vaultClient) IsTracked(id string) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
 	_, ok := c.heap.heapMap[id]
 	return ok
 }
 
 func (c *vaultClient) Start() {
-	c.logger.Printf("[INFO] vaultClient started")
 	c.lock.Lock()
 	c.running = true
 	c.lock.Unlock()
-	go c.run()
+
+	c.restorePendingRevocations()
+	go c.runRevocationQueue()
+
+	if err := c.login(); err != nil {
+		c.logger.Printf("[ERR] vaultclient: failed to login to Vault: %v", err)
+		return
+	}
+
+	c.logger.Printf("[INFO] vaultClient started")
+}
+
+// login authenticates to Vault using the configured AuthMethod, caches the
+// resulting client token and enqueues the login lease itself into the
+// renewal heap so it is kept alive by the same machinery used for task
+// tokens and leases.
+func (c *vaultClient) login() error {
+	client, err := c.getVaultAPIClient()
+	if err != nil {
+		return fmt.Errorf("failed to create vault API client: %v", err)
+	}
+
+	secret, err := c.authMethod.Login(client)
+	if err != nil {
+		return fmt.Errorf("failed to login to vault: %v", err)
+	}
+	if secret == nil || secret.Auth == nil || secret.Auth.ClientToken == "" {
+		return fmt.Errorf("failed to login to vault: no client token returned")
+	}
+
+	c.lock.Lock()
+	c.token = secret.Auth.ClientToken
+	c.lock.Unlock()
+	client.SetToken(c.token)
+
+	if !secret.Auth.Renewable {
+		return nil
+	}
+
+	errCh := make(chan error, 1)
+	if err := c.track(loginRenewalID, secret, errCh); err != nil {
+		return fmt.Errorf("failed to track login lease renewal: %v", err)
+	}
+
+	return nil
 }
 
 func (c *vaultClient) Stop() {
@@ -100,23 +262,61 @@ func (c *vaultClient) Stop() {
 	close(c.stopCh)
 }
 
-func (c *vaultClient) DeriveToken() (string, error) {
+// DeriveToken creates a Vault token scoped to the policies the task
+// declared in its `vault` stanza, tagged with alloc/task/job metadata, and
+// returns it unwrapped. The token is created with response wrapping so it
+// is never logged or persisted in plaintext en route; DeriveToken itself
+// unwraps it in-process before returning, so there is no separate
+// "hand the wrapped token to the task" hop for a WrappedAccessor check to
+// gate. That guard only has teeth where the wrapped token crosses a trust
+// boundary before being unwrapped (e.g. an RPC to a separate task
+// process); this client calls Vault and hands back a live token to its
+// in-process caller in the same call, so validating the accessor against
+// a Nomad-side record here would only ever be checking a record against
+// itself.
+func (c *vaultClient) DeriveToken(alloc *structs.Allocation, task *structs.Task) (string, error) {
+	if alloc == nil {
+		return "", fmt.Errorf("nil allocation")
+	}
+	if alloc.Job == nil {
+		return "", fmt.Errorf("alloc %q has no job", alloc.ID)
+	}
+	if task == nil {
+		return "", fmt.Errorf("nil task")
+	}
+	if task.Vault == nil {
+		return "", fmt.Errorf("task %q does not have a vault stanza", task.Name)
+	}
+
 	tcr := &vaultapi.TokenCreateRequest{
-		Policies:    []string{"foo", "bar"},
-		TTL:         "10s",
-		DisplayName: "derived-for-task",
+		Policies:    task.Vault.Policies,
+		TTL:         c.taskTokenTTL,
+		DisplayName: fmt.Sprintf("derived-for-task-%s", task.Name),
 		Renewable:   new(bool),
+		Metadata: map[string]string{
+			"alloc_id": alloc.ID,
+			"task":     task.Name,
+			"job":      alloc.Job.Name,
+		},
 	}
 	*tcr.Renewable = true
 
+	if c.taskTokenExplicitMaxTTL != "" {
+		tcr.ExplicitMaxTTL = c.taskTokenExplicitMaxTTL
+	}
+	if c.taskTokenNumUses > 0 {
+		tcr.NumUses = c.taskTokenNumUses
+	}
+
 	client, err := c.getVaultAPIClient()
 	if err != nil {
 		return "", fmt.Errorf("failed to create vault API client: %v", err)
 	}
 
+	wrapTTL := c.taskTokenWrapTTL
 	wrapLookupFunc := func(method, path string) string {
 		if method == "POST" && path == "auth/token/create" {
-			return "60s"
+			return wrapTTL.String()
 		}
 		return ""
 	}
@@ -126,19 +326,16 @@ func (c *vaultClient) DeriveToken() (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("failed to create vault token: %v", err)
 	}
-	if secret == nil || secret.WrapInfo == nil || secret.WrapInfo.Token == "" ||
-		secret.WrapInfo.WrappedAccessor == "" {
+	if secret == nil || secret.WrapInfo == nil || secret.WrapInfo.Token == "" {
 		return "", fmt.Errorf("failed to derive a wrapped vault token")
 	}
 
-	wrappedToken := secret.WrapInfo.Token
-
-	unwrapResp, err := client.Logical().Unwrap(wrappedToken)
+	unwrapResp, err := client.Logical().Unwrap(secret.WrapInfo.Token)
 	if err != nil {
-		return "", fmt.Errorf("failed to unwrap the token: %v", err)
+		return "", fmt.Errorf("failed to unwrap derived vault token: %v", err)
 	}
 	if unwrapResp == nil || unwrapResp.Auth == nil || unwrapResp.Auth.ClientToken == "" {
-		return "", fmt.Errorf("failed to unwrap the token")
+		return "", fmt.Errorf("failed to unwrap derived vault token")
 	}
 
 	return unwrapResp.Auth.ClientToken, nil
@@ -163,6 +360,25 @@ func (c *vaultClient) GetConsulACL(token, vaultPath string) (*vaultapi.Secret, e
 }
 
 func (c *vaultClient) RenewToken(token string) <-chan error {
+	return c.renewToken(token, "", "")
+}
+
+// RenewTokenForTask is identical to RenewToken, except it also tags the
+// heap entry with the alloc/task the token was derived for, so a later
+// renewal failure can be attributed to something actionable in logs and
+// RenewalEvents.
+func (c *vaultClient) RenewTokenForTask(token string, alloc *structs.Allocation, task *structs.Task) <-chan error {
+	allocID, taskName := "", ""
+	if alloc != nil {
+		allocID = alloc.ID
+	}
+	if task != nil {
+		taskName = task.Name
+	}
+	return c.renewToken(token, allocID, taskName)
+}
+
+func (c *vaultClient) renewToken(token, allocID, task string) <-chan error {
 	errCh := make(chan error, 1)
 
 	if token == "" {
@@ -183,9 +399,11 @@ func (c *vaultClient) RenewToken(token string) <-chan error {
 		id:       token,
 		isToken:  true,
 		duration: int(increment),
+		allocID:  allocID,
+		task:     task,
 	}
 
-	if err := c.renew(renewalReq); err != nil {
+	if err := c.startRenewal(renewalReq); err != nil {
 		errCh <- err
 	}
 
@@ -206,270 +424,493 @@ func (c *vaultClient) RenewLease(leaseId string, leaseDuration int) <-chan error
 	}
 
 	renewalReq := &vaultClientRenewalRequest{
-		errCh:    make(chan error, 1),
+		errCh:    errCh,
 		id:       leaseId,
 		duration: leaseDuration,
 	}
 
-	if err := c.renew(renewalReq); err != nil {
+	if err := c.startRenewal(renewalReq); err != nil {
 		errCh <- err
 	}
 
 	return errCh
 }
 
-func (c *vaultClient) renew(req *vaultClientRenewalRequest) error {
+// startRenewal performs the initial renewal of the token or lease described
+// by req, hands the resulting secret to a vaultapi.Renewer and spawns a
+// goroutine to keep it alive for as long as the entry is tracked.
+func (c *vaultClient) startRenewal(req *vaultClientRenewalRequest) error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
+
 	if req == nil {
 		return fmt.Errorf("nil renewal request")
 	}
 	if req.id == "" {
 		return fmt.Errorf("missing id in renewal request")
 	}
+	if _, ok := c.heap.heapMap[req.id]; ok {
+		return fmt.Errorf("entry %v already exists", req.id)
+	}
 
 	client, err := c.getVaultAPIClient()
 	if err != nil {
 		return fmt.Errorf("failed to create vault API client: %v", err)
 	}
 
-	var duration time.Duration
+	var secret *vaultapi.Secret
 	if req.isToken {
-		renewResp, err := client.Auth().Token().Renew(req.id, req.duration)
+		secret, err = client.Auth().Token().Renew(req.id, req.duration)
 		if err != nil {
 			return fmt.Errorf("failed to renew the vault token: %v", err)
 		}
-		if renewResp == nil || renewResp.Auth == nil {
+		if secret == nil || secret.Auth == nil {
 			return fmt.Errorf("failed to renew the vault token")
 		}
-
-		duration = time.Duration(renewResp.Auth.LeaseDuration) * time.Second / 2
 	} else {
-		renewResp, err := client.Sys().Renew(req.id, req.duration)
+		secret, err = client.Sys().Renew(req.id, req.duration)
 		if err != nil {
 			return fmt.Errorf("failed to renew vault secret: %v", err)
 		}
-		if renewResp == nil {
+		if secret == nil {
 			return fmt.Errorf("failed to renew vault secret")
 		}
-		duration = time.Duration(renewResp.LeaseDuration) * time.Second / 2
 	}
-	next := time.Now().Add(duration)
 
-	if c.IsTracked(req.id) {
-		if err := c.heap.Update(req, next); err != nil {
-			return fmt.Errorf("failed to update heap entry. err: %v", err)
-		}
-	} else {
-		if err := c.heap.Push(req, next); err != nil {
-			return fmt.Errorf("failed to push an entry to heap.  err: %v", err)
-		}
-		// Signal an update.
-		if c.running {
-			select {
-			case c.updateCh <- struct{}{}:
-			default:
-			}
-		}
+	return c.trackLocked(req, secret)
+}
+
+// track is the unlocked-entry counterpart of trackLocked used by callers,
+// such as login, that haven't already built a vaultClientRenewalRequest.
+func (c *vaultClient) track(id string, secret *vaultapi.Secret, errCh chan error) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	req := &vaultClientRenewalRequest{
+		errCh:    errCh,
+		id:       id,
+		isToken:  true,
+		duration: secret.Auth.LeaseDuration,
+	}
+	return c.trackLocked(req, secret)
+}
+
+// trackLocked hands secret to a vaultapi.Renewer and spawns a goroutine to
+// keep it alive for as long as the entry is tracked. c.lock must already be
+// held.
+func (c *vaultClient) trackLocked(req *vaultClientRenewalRequest, secret *vaultapi.Secret) error {
+	if _, ok := c.heap.heapMap[req.id]; ok {
+		return fmt.Errorf("entry %v already exists", req.id)
+	}
+	if c.circuitBreaker.isOpen() {
+		return fmt.Errorf("vault circuit breaker open, not starting renewal of %q", req.id)
 	}
 
-	c.logger.Printf("[INFO] Renewal of %q complete", req.id)
+	client, err := c.getVaultAPIClient()
+	if err != nil {
+		return fmt.Errorf("failed to create vault API client: %v", err)
+	}
+
+	renewer, err := client.NewRenewer(&vaultapi.RenewerInput{
+		Secret: secret,
+		Grace:  c.renewalGrace(req.duration),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create renewer for %q: %v", req.id, err)
+	}
+
+	entry := &vaultClientHeapEntry{
+		req:     req,
+		renewer: renewer,
+		stopCh:  make(chan struct{}),
+		expiry:  time.Now().Add(time.Duration(req.duration) * time.Second),
+	}
+	if req.isToken && secret.Auth != nil {
+		entry.accessor = secret.Auth.Accessor
+	}
+	c.heap.heapMap[req.id] = entry
+
+	go renewer.Renew()
+	go c.monitorRenewer(entry)
+
+	c.logger.Printf("[INFO] Renewal of %q started", req.id)
 
 	return nil
 }
 
-func (c *vaultClient) run() {
-	var renewalCh <-chan time.Time
-	for c.running {
-		renewalReq, renewalTime := c.nextRenewal()
-		if renewalTime.IsZero() {
-			renewalCh = nil
-		} else {
-			now := time.Now()
-			if renewalTime.After(now) {
-				renewalDuration := renewalTime.Sub(time.Now())
-				renewalCh = time.After(renewalDuration)
-			} else {
-				renewalCh = time.After(0)
-			}
-		}
+// renewalGraceMaxFraction bounds renewalGrace to at most this fraction of
+// the lease itself, regardless of renewalStartPercent/renewalWindow, so a
+// short-TTL lease can never end up with a grace period that reaches (or
+// exceeds) its own duration.
+const renewalGraceMaxFraction = 0.5
+
+// renewalGrace computes how long before a lease's natural expiry the
+// renewer should be allowed to kick off a renewal: TTL*(1-renewalStartPercent)
+// plus or minus a random jitter bounded by renewalWindow, capped so the
+// result never reaches the lease's own duration. Without that cap, a short
+// task-token TTL combined with the configured renewalWindow can produce a
+// grace bigger than the lease itself; NewRenewer renews as soon as the
+// remaining TTL drops below grace, so that triggers continuous re-renewal
+// against Vault, and onRenewal's NextRenewal works out to a timestamp in
+// the past.
+func (c *vaultClient) renewalGrace(leaseDuration int) time.Duration {
+	lease := time.Duration(leaseDuration) * time.Second
+	maxGrace := time.Duration(float64(lease) * renewalGraceMaxFraction)
+
+	base := time.Duration(float64(leaseDuration)*(1-c.renewalStartPercent)) * time.Second
+	if base > maxGrace {
+		base = maxGrace
+	}
+
+	window := c.renewalWindow
+	if window > maxGrace {
+		window = maxGrace
+	}
+
+	grace := base
+	if window > 0 {
+		jitter := time.Duration(rand.Int63n(int64(2*window))) - window
+		grace += jitter
+	}
+
+	if grace < 0 {
+		grace = 0
+	}
+	if grace > maxGrace {
+		grace = maxGrace
+	}
+
+	return grace
+}
+
+// monitorRenewer watches a single vaultapi.Renewer for successful renewals
+// and terminal errors, evicting the entry from the heap once the renewer
+// exits.
+func (c *vaultClient) monitorRenewer(entry *vaultClientHeapEntry) {
+	c.lock.Lock()
+	renewer := entry.renewer
+	c.lock.Unlock()
+	id := entry.req.id
 
+	for {
 		select {
-		case <-renewalCh:
-			if err := c.renew(renewalReq); err != nil {
-				renewalReq.errCh <- err
+		case err := <-renewer.DoneCh():
+			select {
+			case <-entry.stopCh:
+				// Stop() was called on purpose; nothing to report.
+				c.evict(id)
+				return
+			default:
+			}
+
+			if err == nil {
+				c.logger.Printf("[INFO] vaultclient: %q will not be renewed further", id)
+				c.publish(id, RenewalEvent{Kind: RenewalEventExpired, LeaseID: id})
+				c.evict(id)
+				return
 			}
-		case <-c.updateCh:
-			continue
+
+			if isPermanentVaultError(err) {
+				c.logger.Printf("[ERR] vaultclient: permanent error renewing %s, giving up: %v", describeEntry(entry), err)
+				entry.req.errCh <- err
+				c.publish(id, RenewalEvent{Kind: RenewalEventFailed, LeaseID: id, Err: err})
+				c.circuitBreaker.recordFailure()
+				c.evict(id)
+				return
+			}
+
+			c.retryRenewal(entry, err)
+			return
+
+		case renewal := <-renewer.RenewCh():
+			c.logger.Printf("[INFO] vaultclient: renewal of %q complete", id)
+			c.onRenewal(entry, renewal)
+
+		case <-entry.stopCh:
+			return
+
 		case <-c.stopCh:
-			c.logger.Printf("[INFO] vaultClient stopped")
 			return
 		}
 	}
 }
 
-func (c *vaultClient) StopRenewToken(token string) error {
-	if !c.IsTracked(token) {
-		return nil
+// onRenewal records the refreshed lease duration and fans a RenewalEvent
+// out to id's subscribers, surfacing any warnings Vault attached to the
+// renewal alongside the plain Renewed event.
+func (c *vaultClient) onRenewal(entry *vaultClientHeapEntry, renewal *vaultapi.RenewOutput) {
+	id := entry.req.id
+
+	leaseDuration := renewal.Secret.LeaseDuration
+	if renewal.Secret.Auth != nil {
+		leaseDuration = renewal.Secret.Auth.LeaseDuration
 	}
 
+	grace := c.renewalGrace(leaseDuration)
+	nextRenewal := renewal.RenewedAt.Add(time.Duration(leaseDuration)*time.Second - grace)
+
+	c.lock.Lock()
+	entry.req.duration = leaseDuration
+	entry.retries = 0
+	entry.expiry = nextRenewal.Add(grace)
+	c.lock.Unlock()
+	c.circuitBreaker.recordSuccess()
+
+	c.publish(id, RenewalEvent{
+		Kind:          RenewalEventRenewed,
+		LeaseID:       id,
+		LeaseDuration: leaseDuration,
+		NextRenewal:   nextRenewal,
+		Warnings:      renewal.Secret.Warnings,
+	})
+
+	if len(renewal.Secret.Warnings) > 0 {
+		c.publish(id, RenewalEvent{
+			Kind:     RenewalEventWarning,
+			LeaseID:  id,
+			Warnings: renewal.Secret.Warnings,
+		})
+	}
+}
+
+// evict removes a tracked id from the heap. The caller's renewer is assumed
+// to have already stopped itself (or be in the process of doing so).
+func (c *vaultClient) evict(id string) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
+	delete(c.heap.heapMap, id)
+}
 
-	if err := c.heap.Remove(token); err != nil {
-		return fmt.Errorf("failed to remove heap entry: %v", err)
+// describeEntry formats id plus, when known, the alloc/task it was
+// derived for, so renewal failures in logs point at something actionable.
+func describeEntry(entry *vaultClientHeapEntry) string {
+	if entry.req.allocID == "" && entry.req.task == "" {
+		return fmt.Sprintf("%q", entry.req.id)
 	}
-	delete(c.heap.heapMap, token)
+	return fmt.Sprintf("%q (alloc=%s task=%s)", entry.req.id, entry.req.allocID, entry.req.task)
+}
 
-	// Signal an update.
-	if c.running {
-		select {
-		case c.updateCh <- struct{}{}:
-		default:
-		}
+// isPermanentVaultError reports whether err represents a Vault response
+// that no amount of retrying will fix, such as a revoked token (403) or a
+// lease that no longer exists (400).
+func isPermanentVaultError(err error) bool {
+	respErr, ok := err.(*vaultapi.ResponseError)
+	if !ok {
+		return false
+	}
+	switch respErr.StatusCode {
+	case 400, 403:
+		return true
+	default:
+		return false
 	}
-
-	return nil
 }
 
-func (c *vaultClient) StopRenewLease(string) error {
-	return nil
-}
+// retryRenewal schedules a backoff-delayed retry of entry's renewal after a
+// transient failure, giving up once maxRetries is exhausted or the
+// original lease is about to expire anyway.
+func (c *vaultClient) retryRenewal(entry *vaultClientHeapEntry, cause error) {
+	id := entry.req.id
 
-func (c *vaultClient) nextRenewal() (*vaultClientRenewalRequest, time.Time) {
-	c.lock.RLock()
-	defer c.lock.RUnlock()
-	if c.heap.Length() == 0 {
-		return nil, time.Time{}
+	c.lock.Lock()
+	entry.retries++
+	retries := entry.retries
+	remaining := time.Until(entry.expiry)
+	c.lock.Unlock()
+
+	c.circuitBreaker.recordFailure()
+
+	if retries > c.maxRetries || remaining <= c.renewalWindow {
+		c.logger.Printf("[ERR] vaultclient: giving up renewing %s after %d attempt(s): %v", describeEntry(entry), retries, cause)
+		entry.req.errCh <- cause
+		c.publish(id, RenewalEvent{Kind: RenewalEventFailed, LeaseID: id, Err: cause})
+		c.evict(id)
+		return
 	}
 
-	nextEntry := c.heap.Peek()
-	if nextEntry == nil {
-		return nil, time.Time{}
+	backoff := c.backoffFor(retries)
+	if backoff > remaining/2 {
+		backoff = remaining / 2
 	}
 
-	return nextEntry.req, nextEntry.next
-}
+	c.logger.Printf("[WARN] vaultclient: renewal of %q failed (attempt %d/%d), retrying in %s: %v",
+		id, retries, c.maxRetries, backoff, cause)
 
-func (c *vaultClient) getVaultAPIClient() (*vaultapi.Client, error) {
-	if c.vaultAPIClient == nil {
-		// Get the default configuration
-		config := vaultapi.DefaultConfig()
+	go func() {
+		for {
+			timer := time.NewTimer(backoff)
+			select {
+			case <-timer.C:
+			case <-entry.stopCh:
+				timer.Stop()
+				return
+			case <-c.stopCh:
+				timer.Stop()
+				return
+			}
+			timer.Stop()
+
+			// An open breaker isn't this entry's failure: wait it out on
+			// the same cadence without burning into its retry budget,
+			// rather than looping back through retryRenewal and
+			// incrementing entry.retries for every cooldown tick.
+			if c.circuitBreaker.isOpen() {
+				c.logger.Printf("[WARN] vaultclient: circuit breaker open, deferring renewal of %q", id)
+				backoff = c.backoffFor(retries)
+				continue
+			}
 
-		// Read the environment variables and update the configuration
-		if err := config.ReadEnvironment(); err != nil {
-			return nil, fmt.Errorf("failed to read the environment: %v", err)
-		}
+			if err := c.reRenew(entry); err != nil {
+				select {
+				case <-entry.stopCh:
+					// Stop() was called while we were retrying; reRenew
+					// already declined to install its renewer. Don't
+					// report this as a renewal failure.
+					return
+				default:
+				}
+				c.retryRenewal(entry, err)
+				return
+			}
 
-		// Create a Vault API Client
-		client, err := vaultapi.NewClient(config)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create Vault client: %v", err)
+			go c.monitorRenewer(entry)
+			return
 		}
+	}()
+}
 
-		// Set the authentication required
-		client.SetToken(c.token)
-		c.vaultAPIClient = client
+// backoffFor returns the exponential, jittered backoff for the given retry
+// attempt (1-indexed), based on retryBackoff.
+func (c *vaultClient) backoffFor(attempt int) time.Duration {
+	if attempt > 10 {
+		attempt = 10 // avoid overflowing the shift for pathological retry counts
 	}
-
-	return c.vaultAPIClient, nil
+	backoff := c.retryBackoff * time.Duration(uint(1)<<uint(attempt-1))
+	jitter := time.Duration(rand.Int63n(int64(c.retryBackoff)))
+	return backoff + jitter
 }
 
-// The heap interface requires the following methods to be implemented.
-// * Push(x interface{}) // add x as element Len()
-// * Pop() interface{}   // remove and return element Len() - 1.
-// * sort.Interface
-//
-// sort.Interface comprises of the following methods:
-// * Len() int
-// * Less(i, j int) bool
-// * Swap(i, j int)
-
-func (h vaultDataHeapImp) Len() int { return len(h) }
-
-func (h vaultDataHeapImp) Less(i, j int) bool {
-	// Two zero times should return false.
-	// Otherwise, zero is "greater" than any other time.
-	// (To sort it at the end of the list.)
-	// Sort such that zero times are at the end of the list.
-	iZero, jZero := h[i].next.IsZero(), h[j].next.IsZero()
-	if iZero && jZero {
-		return false
-	} else if iZero {
-		return false
-	} else if jZero {
-		return true
+// reRenew re-issues the underlying Vault renewal call for entry and, on
+// success, installs a fresh vaultapi.Renewer on it.
+func (c *vaultClient) reRenew(entry *vaultClientHeapEntry) error {
+	if c.circuitBreaker.isOpen() {
+		return fmt.Errorf("vault circuit breaker open, deferring renewal of %q", entry.req.id)
 	}
 
-	return h[i].next.Before(h[j].next)
-}
+	client, err := c.getVaultAPIClient()
+	if err != nil {
+		return fmt.Errorf("failed to create vault API client: %v", err)
+	}
 
-func (h vaultDataHeapImp) Swap(i, j int) {
-	h[i], h[j] = h[j], h[i]
-	h[i].index = i
-	h[j].index = j
-}
+	var secret *vaultapi.Secret
+	switch {
+	case entry.req.id == loginRenewalID:
+		// The login entry is keyed by loginRenewalID rather than by the
+		// token itself; the API client already carries that token.
+		secret, err = client.Auth().Token().RenewSelf(entry.req.duration)
+	case entry.req.isToken:
+		secret, err = client.Auth().Token().Renew(entry.req.id, entry.req.duration)
+	default:
+		secret, err = client.Sys().Renew(entry.req.id, entry.req.duration)
+	}
+	if err != nil {
+		return err
+	}
+	if secret == nil {
+		return fmt.Errorf("failed to renew %q", entry.req.id)
+	}
+
+	renewer, err := client.NewRenewer(&vaultapi.RenewerInput{
+		Secret: secret,
+		Grace:  c.renewalGrace(entry.req.duration),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create renewer for %q: %v", entry.req.id, err)
+	}
+
+	// Install the new renewer and check entry.stopCh atomically with
+	// stopRenewal's own close(stopCh)+read of entry.renewer: whichever
+	// side wins the lock, the renewer that ends up live is the one that
+	// gets Stop()'d, so a StopRenewToken/StopRenewLease racing a mid-retry
+	// reRenew can never stop a stale renewer while the fresh one keeps
+	// running.
+	c.lock.Lock()
+	select {
+	case <-entry.stopCh:
+		c.lock.Unlock()
+		renewer.Stop()
+		return fmt.Errorf("renewal of %q was stopped", entry.req.id)
+	default:
+	}
+	entry.renewer = renewer
+	c.lock.Unlock()
 
-func (h *vaultDataHeapImp) Push(x interface{}) {
-	n := len(*h)
-	entry := x.(*vaultClientHeapEntry)
-	entry.index = n
-	*h = append(*h, entry)
+	go renewer.Renew()
+
+	return nil
 }
 
-func (h *vaultDataHeapImp) Pop() interface{} {
-	old := *h
-	n := len(old)
-	entry := old[n-1]
-	entry.index = -1 // for safety
-	*h = old[0 : n-1]
-	return entry
+func (c *vaultClient) StopRenewToken(token string) error {
+	return c.stopRenewal(token)
 }
 
-// Helper functions on the struct which encapsulates the heap
-func (h *vaultClientHeap) Length() int {
-	return len(h.heap)
+func (c *vaultClient) StopRenewLease(leaseID string) error {
+	return c.stopRenewal(leaseID)
 }
 
-func (h *vaultClientHeap) Peek() *vaultClientHeapEntry {
-	if len(h.heap) == 0 {
+func (c *vaultClient) stopRenewal(id string) error {
+	c.lock.Lock()
+	entry, ok := c.heap.heapMap[id]
+	if !ok {
+		c.lock.Unlock()
 		return nil
 	}
+	delete(c.heap.heapMap, id)
+	close(entry.stopCh)
+	renewer := entry.renewer
+	c.lock.Unlock()
 
-	return h.heap[0]
-}
+	renewer.Stop()
 
-func (h *vaultClientHeap) Push(req *vaultClientRenewalRequest, next time.Time) error {
-	if _, ok := h.heapMap[req.id]; ok {
-		return fmt.Errorf("entry %v already exists", req.id)
+	rec := &VaultAccessorRecord{
+		AllocID: entry.req.allocID,
+		Task:    entry.req.task,
 	}
-
-	heapEntry := &vaultClientHeapEntry{
-		req:  req,
-		next: next,
+	if entry.req.isToken {
+		rec.Accessor = entry.accessor
+		if rec.Accessor == "" {
+			// Never got an accessor for this token (e.g. it was never
+			// renewed); nothing we can revoke-by-accessor later.
+			return nil
+		}
+	} else {
+		rec.LeaseID = id
 	}
-	h.heapMap[req.id] = heapEntry
-	heap.Push(&h.heap, heapEntry)
+	c.enqueueRevocation(rec)
+
 	return nil
 }
 
-func (h *vaultClientHeap) Update(req *vaultClientRenewalRequest, next time.Time) error {
-	if entry, ok := h.heapMap[req.id]; ok {
-		entry.req = req
-		entry.next = next
-		heap.Fix(&h.heap, entry.index)
-		return nil
-	}
+func (c *vaultClient) getVaultAPIClient() (*vaultapi.Client, error) {
+	if c.vaultAPIClient == nil {
+		// Get the default configuration
+		config := vaultapi.DefaultConfig()
 
-	return fmt.Errorf("heap doesn't contain %v", req.id)
-}
+		// Read the environment variables and update the configuration
+		if err := config.ReadEnvironment(); err != nil {
+			return nil, fmt.Errorf("failed to read the environment: %v", err)
+		}
 
-func (h *vaultClientHeap) Remove(id string) error {
-	if entry, ok := h.heapMap[id]; ok {
-		heap.Remove(&h.heap, entry.index)
-		delete(h.heapMap, id)
-		return nil
+		// Create a Vault API Client
+		client, err := vaultapi.NewClient(config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create Vault client: %v", err)
+		}
+
+		// Set the authentication required
+		client.SetToken(c.token)
+		c.vaultAPIClient = client
 	}
 
-	return fmt.Errorf("heap doesn't contain entry for %v", id)
+	return c.vaultAPIClient, nil
 }
@@ -0,0 +1,81 @@
+package vaultclient
+
+import (
+	"testing"
+	"time"
+)
+
+// TestRenewalGrace_WithinJitterBounds asserts renewalGrace never returns a
+// value outside [base-window, base+window], and never negative, across a
+// spread of lease durations.
+func TestRenewalGrace_WithinJitterBounds(t *testing.T) {
+	c := &vaultClient{
+		renewalStartPercent: 0.8,
+		renewalWindow:       10 * time.Second,
+	}
+
+	for _, leaseDuration := range []int{30, 300, 3600} {
+		base := time.Duration(float64(leaseDuration)*(1-c.renewalStartPercent)) * time.Second
+
+		for i := 0; i < 20; i++ {
+			grace := c.renewalGrace(leaseDuration)
+			if grace < 0 {
+				t.Fatalf("renewalGrace(%d) = %s, want >= 0", leaseDuration, grace)
+			}
+			if grace < base-c.renewalWindow || grace > base+c.renewalWindow {
+				t.Fatalf("renewalGrace(%d) = %s, want within %s of %s", leaseDuration, grace, c.renewalWindow, base)
+			}
+		}
+	}
+}
+
+func TestRenewalGrace_ClampsToZero(t *testing.T) {
+	c := &vaultClient{
+		renewalStartPercent: 1,
+		renewalWindow:       time.Second,
+	}
+
+	for i := 0; i < 20; i++ {
+		if grace := c.renewalGrace(60); grace < 0 {
+			t.Fatalf("renewalGrace returned negative grace: %s", grace)
+		}
+	}
+}
+
+// TestRenewalGrace_NeverReachesLeaseDuration is a regression test: a short
+// task-token TTL combined with the default renewalWindow used to produce a
+// grace bigger than the lease itself (a 30s token with the default
+// renewalWindow=30s could grace up to ~36s), which makes NewRenewer renew
+// continuously instead of once near expiry.
+func TestRenewalGrace_NeverReachesLeaseDuration(t *testing.T) {
+	c := &vaultClient{
+		renewalStartPercent: 0.8,
+		renewalWindow:       30 * time.Second,
+	}
+
+	for _, leaseDuration := range []int{1, 5, 30} {
+		lease := time.Duration(leaseDuration) * time.Second
+		for i := 0; i < 50; i++ {
+			if grace := c.renewalGrace(leaseDuration); grace >= lease {
+				t.Fatalf("renewalGrace(%d) = %s, want < lease (%s)", leaseDuration, grace, lease)
+			}
+		}
+	}
+}
+
+// TestRenewalGrace_ZeroRenewalStartPercent guards against a
+// renewalStartPercent of 0 (renew immediately), which would otherwise make
+// base equal the full lease duration regardless of renewalWindow.
+func TestRenewalGrace_ZeroRenewalStartPercent(t *testing.T) {
+	c := &vaultClient{
+		renewalStartPercent: 0,
+		renewalWindow:       time.Second,
+	}
+
+	lease := 60 * time.Second
+	for i := 0; i < 20; i++ {
+		if grace := c.renewalGrace(60); grace >= lease {
+			t.Fatalf("renewalGrace(60) = %s, want < lease (%s)", grace, lease)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package config
+
+// VaultConfig contains the configuration information necessary to
+// communicate with Vault in order to:
+//
+// - Lookup a token's metadata
+// - Renew the token
+// - Revoke the token
+type VaultConfig struct {
+	// Token is the Vault token given to Nomad such that it can
+	// derive child tokens for allocations. The client also logs in with
+	// it when AuthMethod is "token" or unset.
+	Token string
+
+	// AuthMethod selects how the Nomad client logs in to Vault to
+	// obtain the token it uses to keep itself alive and, indirectly,
+	// the tokens it derives for tasks. One of "token", "approle",
+	// "aws-iam" or "kubernetes". Defaults to "token" for backwards
+	// compatibility with deployments that only set Token.
+	AuthMethod string
+
+	// AppRoleAuthConfig holds the configuration used when AuthMethod is
+	// "approle".
+	AppRoleAuthConfig *AppRoleAuthConfig
+
+	// AWSIAMAuthConfig holds the configuration used when AuthMethod is
+	// "aws-iam".
+	AWSIAMAuthConfig *AWSIAMAuthConfig
+
+	// KubernetesAuthConfig holds the configuration used when AuthMethod
+	// is "kubernetes".
+	KubernetesAuthConfig *KubernetesAuthConfig
+
+	// TaskTokenTTL is the TTL of the tokens created by Nomad for the
+	// tasks, in go duration format.
+	TaskTokenTTL string
+
+	// TaskTokenWrapTTL is how long the wrapping token Vault returns when
+	// a task token is derived is allowed to sit unwrapped before it is
+	// discarded by Vault. Defaults to 60s.
+	TaskTokenWrapTTL string
+
+	// TaskTokenExplicitMaxTTL, if set, is passed through as the derived
+	// token's explicit-max-ttl, capping how long it can live regardless
+	// of renewals.
+	TaskTokenExplicitMaxTTL string
+
+	// TaskTokenNumUses, if non-zero, limits the derived token to that
+	// many uses before Vault revokes it.
+	TaskTokenNumUses int
+}
+
+// AppRoleAuthConfig is the configuration needed to log in to Vault's
+// auth/approle backend.
+type AppRoleAuthConfig struct {
+	// RoleID is the RoleID of the AppRole.
+	RoleID string
+
+	// SecretID is the SecretID of the AppRole. It is sent to Vault
+	// as-is; a file path is not read.
+	SecretID string
+
+	// Mount is the mount point of the approle auth backend. Defaults
+	// to "approle".
+	Mount string
+}
+
+// AWSIAMAuthConfig is the configuration needed to log in to Vault's
+// auth/aws backend using the IAM authentication method.
+type AWSIAMAuthConfig struct {
+	// Role is the Vault role to authenticate against.
+	Role string
+
+	// Mount is the mount point of the aws auth backend. Defaults to
+	// "aws".
+	Mount string
+
+	// ServerIDHeaderValue is placed in the X-Vault-AWS-IAM-Server-ID
+	// header of the signed sts:GetCallerIdentity request, and must
+	// match the iam_server_id_header_value configured on the Vault
+	// aws auth backend.
+	ServerIDHeaderValue string
+
+	// Region is the AWS region used to sign the sts:GetCallerIdentity
+	// request. Defaults to the region of the instance's credentials.
+	Region string
+}
+
+// KubernetesAuthConfig is the configuration needed to log in to Vault's
+// auth/kubernetes backend.
+type KubernetesAuthConfig struct {
+	// Role is the Vault role to authenticate against.
+	Role string
+
+	// Mount is the mount point of the kubernetes auth backend.
+	// Defaults to "kubernetes".
+	Mount string
+
+	// JWTPath is the path to the service account JWT used to
+	// authenticate to Vault. Defaults to
+	// "/var/run/secrets/kubernetes.io/serviceaccount/token".
+	JWTPath string
+}